@@ -2,17 +2,169 @@ package cot
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"encoding/json"
 	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
 )
 
 type Database struct {
-	Server  string
-	Name    string
-	Panicky bool
+	Server   string
+	Name     string
+	Username string
+	Password string
+	Client   *http.Client
+
+	sessionMu     sync.RWMutex
+	sessionCookie *http.Cookie
+}
+
+// session returns the currently cached AuthSession cookie, if any. Safe
+// to call concurrently, including from a Database.Changes goroutine
+// running alongside other requests on the same Database.
+func (db *Database) session() *http.Cookie {
+	db.sessionMu.RLock()
+	defer db.sessionMu.RUnlock()
+	return db.sessionCookie
+}
+
+func (db *Database) setSession(cookie *http.Cookie) {
+	db.sessionMu.Lock()
+	defer db.sessionMu.Unlock()
+	db.sessionCookie = cookie
+}
+
+// httpClient returns the *http.Client to use for requests, falling back to
+// a bare client (net/http's defaults) when Client is not set. Supplying a
+// Client lets callers configure TLS, timeouts, or connection pooling.
+func (db *Database) httpClient() *http.Client {
+	if db.Client != nil {
+		return db.Client
+	}
+	return &http.Client{}
+}
+
+// newRequest builds a request against this database, attaching whatever
+// credentials are available (see authenticate): a cached session cookie if
+// one has been established, and HTTP Basic Auth if Username is set.
+func (db *Database) newRequest(method, path string, body interface{}) (*http.Request, error) {
+	var reader *bytes.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, path, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.Header.Add("content-type", "application/json")
+	}
+
+	db.authenticate(req)
+
+	return req, nil
+}
+
+// authenticate attaches whatever credentials are available to req: a
+// cached session cookie if one has been established, and/or HTTP Basic
+// Auth if Username is set. Both can be sent together; CouchDB accepts
+// either.
+func (db *Database) authenticate(req *http.Request) {
+	if cookie := db.session(); cookie != nil {
+		req.AddCookie(cookie)
+	}
+	if db.Username != "" {
+		req.SetBasicAuth(db.Username, db.Password)
+	}
+}
+
+// startSession logs in against CouchDB's /_session endpoint and caches the
+// AuthSession cookie it returns, so subsequent requests carry cookie auth.
+// authenticate still adds Basic Auth alongside the cookie when Username is
+// set.
+func (db *Database) startSession() error {
+	form := url.Values{}
+	form.Set("name", db.Username)
+	form.Set("password", db.Password)
+
+	req, err := http.NewRequest("POST", db.Server + "/_session", bytes.NewReader([]byte(form.Encode())))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("content-type", "application/x-www-form-urlencoded")
+
+	resp, err := db.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newError(req, "", resp)
+	}
+
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "AuthSession" {
+			db.setSession(cookie)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("couchdb did not return an AuthSession cookie")
+}
+
+// do sends req using db's configured client and credentials. If the server
+// responds 401 and Username is set, it re-authenticates once and
+// retries the request before giving up. The retry is skipped when req
+// carries a body that can't be safely re-read (e.g. a streaming
+// PutAttachment upload), since resending it would silently send a
+// partial/empty body; the original 401 response is returned instead.
+func (db *Database) do(req *http.Request) (*http.Response, error) {
+	resp, err := db.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	canRetry := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	if resp.StatusCode == http.StatusUnauthorized && db.Username != "" && canRetry {
+		resp.Body.Close()
+
+		if err = db.startSession(); err != nil {
+			return nil, err
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		req.Header.Del("Cookie")
+		req.AddCookie(db.session())
+
+		return db.httpClient().Do(req)
+	}
+
+	return resp, nil
 }
 
 type ViewQuery struct {
@@ -21,8 +173,32 @@ type ViewQuery struct {
 	MapDef     string
 	ReduceDef  string
 
-	StartKey   interface{}
-	EndKey     interface{}
+	Key           interface{}
+	Keys          []interface{}
+	StartKey      interface{}
+	EndKey        interface{}
+	StartKeyDocID string
+	EndKeyDocID   string
+
+	Limit        int
+	Skip         int
+	Descending   bool
+	Group        bool
+	GroupLevel   int
+	Reduce       *bool
+	IncludeDocs  bool
+	InclusiveEnd *bool
+	Stale        string
+
+	// Language, Lists, Shows, Filters, and ValidateDocUpdate are merged
+	// into the view's design document alongside MapDef/ReduceDef, so a
+	// single ViewQuery can also register the design doc's other
+	// function types.
+	Language          string
+	Lists             map[string]string
+	Shows             map[string]string
+	Filters           map[string]string
+	ValidateDocUpdate string
 }
 
 type ViewQueryRow struct {
@@ -32,16 +208,111 @@ type ViewQueryRow struct {
 	Doc   interface{}  `json:"doc"`
 }
 
-type viewQueryResult struct {
-	TotalRows  int         `json:"total_rows"`
-	Offset     int         `json:"offset"`
-	Rows       interface{} `json:"rows"`
+// ViewQueryRowError mirrors the {from,reason} entries CouchDB adds to a
+// view's errors array when one cluster node fails to answer.
+type ViewQueryRowError struct {
+	From   string `json:"from"`
+	Reason string `json:"reason"`
+}
+
+// ViewResult carries everything CouchDB returns alongside the decoded rows
+// from a view query: the total row count (pre-skip/limit) and any per-node
+// errors, so callers can paginate and detect partial failures.
+type ViewResult struct {
+	TotalRows int                 `json:"total_rows"`
+	Offset    int                 `json:"offset"`
+	Rows      interface{}         `json:"rows"`
+	Errors    []ViewQueryRowError `json:"errors"`
+}
+
+// docResponse mirrors the {ok,id,rev,error,reason} envelope CouchDB returns
+// for every document write, success or failure.
+type docResponse struct {
+	OK     bool   `json:"ok"`
+	ID     string `json:"id"`
+	Rev    string `json:"rev"`
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
+}
+
+// BulkResult is one entry of the array CouchDB returns from /_bulk_docs: a
+// per-document success (ID/Rev set) or failure (Error/Reason set).
+type BulkResult struct {
+	ID     string `json:"id"`
+	Rev    string `json:"rev"`
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
+}
+
+// Error is returned whenever CouchDB responds with a status the call does
+// not treat as success. GetDoc and GetDesignDoc report a 404 as found ==
+// false with a nil error instead. It carries enough of the request/response to let callers log or branch on
+// the failure, and compares equal (via errors.Is) to the sentinel values
+// below when StatusCode matches.
+type Error struct {
+	StatusCode int
+	Err        string
+	Reason     string
+	DocID      string
+	Method     string
+	Path       string
+}
+
+func (e *Error) Error() string {
+	if e.Err != "" {
+		return fmt.Sprintf("cot: %v %v: %v: %v (%v)", e.Method, e.Path, e.StatusCode, e.Err, e.Reason)
+	}
+	return fmt.Sprintf("cot: %v %v: unexpected status code %v", e.Method, e.Path, e.StatusCode)
+}
+
+// Is lets errors.Is(err, cot.ErrNotFound) etc. match any *Error with the
+// same StatusCode, regardless of its DocID/Method/Path/Reason.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	return e.StatusCode == t.StatusCode
+}
+
+// Sentinel errors usable with errors.Is against anything *Database
+// returns.
+var (
+	ErrNotFound     = &Error{StatusCode: http.StatusNotFound}
+	ErrConflict     = &Error{StatusCode: http.StatusConflict}
+	ErrUnauthorized = &Error{StatusCode: http.StatusUnauthorized}
+)
+
+// newError builds an *Error from a non-2xx couchdb response, parsing the
+// {error,reason} body CouchDB sends on failure when present.
+func newError(req *http.Request, docID string, resp *http.Response) *Error {
+	e := &Error{
+		StatusCode: resp.StatusCode,
+		DocID:      docID,
+		Method:     req.Method,
+		Path:       req.URL.String(),
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err == nil {
+		var decoded docResponse
+		if json.Unmarshal(body, &decoded) == nil {
+			e.Err = decoded.Error
+			e.Reason = decoded.Reason
+		}
+	}
+
+	return e
 }
 
 func (db *Database) GetDoc(id string, dest interface{}) (bool, error) {
-	resp, err := http.Get(db.Server + "/" + db.Name + "/" + id)
+	req, err := db.newRequest("GET", db.Server + "/" + db.Name + "/" + id, nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := db.do(req)
 	if err != nil {
-		if db.Panicky { panic(err) }
 		return false, err
 	}
 	defer resp.Body.Close()
@@ -51,20 +322,16 @@ func (db *Database) GetDoc(id string, dest interface{}) (bool, error) {
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("unexpected status code %v from couchdb", resp.StatusCode)
-		if db.Panicky { panic(err) }
-		return false, err
+		return false, newError(req, id, resp)
 	}
-	
+
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		if db.Panicky { panic(err) }
 		return false, err
 	}
 
 	err = json.Unmarshal(body, dest)
 	if err != nil {
-		if db.Panicky { panic(err) }
 		return false, err
 	}
 
@@ -72,86 +339,324 @@ func (db *Database) GetDoc(id string, dest interface{}) (bool, error) {
 }
 
 func (db *Database) PutDoc(id string, doc interface{}) (string, error) {
+	req, err := db.newRequest("PUT", db.Server + "/" + db.Name + "/" + id, doc)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := db.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// A 409 is reported like any other failure below, as an *Error that
+	// matches ErrConflict via errors.Is, rather than swallowed: callers
+	// need that signal to GetDoc the current rev and retry their write.
+	if resp.StatusCode != http.StatusCreated {
+		return "", newError(req, id, resp)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	var responseMap map[string]interface{}
+	err = json.Unmarshal(body, &responseMap)
+	if err != nil {
+		return "", err
+	}
+	return responseMap["rev"].(string), nil
+}
+
+func (db *Database) DeleteDoc(id, rev string) error {
+	req, err := db.newRequest("DELETE", db.Server + "/" + db.Name + "/" + id + "?rev=" + url.QueryEscape(rev), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := db.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newError(req, id, resp)
+	}
+
+	return nil
+}
+
+func (db *Database) UpdateDoc(id, rev string, doc interface{}) (string, error) {
 	encoded, err := json.Marshal(doc)
 	if err != nil {
-		if db.Panicky { panic(err) }
 		return "", err
 	}
-	
-	client := &http.Client{}
-	
-	req, err := http.NewRequest("PUT", db.Server + "/" + db.Name + "/" + id, bytes.NewReader(encoded))
+
+	var docMap map[string]interface{}
+	err = json.Unmarshal(encoded, &docMap)
 	if err != nil {
-		if db.Panicky { panic(err) }
 		return "", err
 	}
-	
-	req.Header.Add("content-type", "application/json")
-	
-	resp, err := client.Do(req)
+	docMap["_id"] = id
+	docMap["_rev"] = rev
+
+	req, err := db.newRequest("PUT", db.Server + "/" + db.Name + "/" + id, docMap)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("If-Match", rev)
+
+	resp, err := db.do(req)
 	if err != nil {
-		if db.Panicky { panic(err) }
 		return "", err
 	}
 	defer resp.Body.Close()
-	
-	switch resp.StatusCode {
-	case http.StatusConflict:
-		return "", nil
-	case http.StatusCreated:
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			if db.Panicky { panic(err) }
-			return "", err
-		}
-		var responseMap map[string]interface{}
-		err = json.Unmarshal(body, &responseMap)
-		if err != nil {
-			if db.Panicky { panic(err) }
-			return "", err
-		}
-		return responseMap["rev"].(string), nil
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", newError(req, id, resp)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var result docResponse
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return "", err
+	}
+
+	return result.Rev, nil
+}
+
+func (db *Database) PostDoc(doc interface{}) (string, string, error) {
+	req, err := db.newRequest("POST", db.Server + "/" + db.Name + "/", doc)
+	if err != nil {
+		return "", "", err
+	}
+
+	resp, err := db.do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", "", newError(req, "", resp)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+
+	var result docResponse
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return "", "", err
+	}
+
+	return result.ID, result.Rev, nil
+}
+
+func (db *Database) BulkDocs(docs []interface{}) ([]BulkResult, error) {
+	body := map[string]interface{}{
+		"docs": docs,
+	}
+
+	req, err := db.newRequest("POST", db.Server + "/" + db.Name + "/_bulk_docs", body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := db.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, newError(req, "", resp)
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []BulkResult
+	err = json.Unmarshal(respBody, &results)
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// InlineAttachment is the {content_type,data} shape CouchDB expects under
+// a document's "_attachments" map for small, base64-encoded blobs.
+type InlineAttachment struct {
+	ContentType string `json:"content_type"`
+	Data        string `json:"data"`
+}
+
+// NewInlineAttachment base64-encodes data for inclusion in a document's
+// "_attachments" map, to be sent inline with PutDoc/UpdateDoc/PostDoc.
+func NewInlineAttachment(contentType string, data []byte) InlineAttachment {
+	return InlineAttachment{
+		ContentType: contentType,
+		Data:        base64.StdEncoding.EncodeToString(data),
+	}
+}
+
+// PutAttachment streams r as the contents of a named attachment on
+// docID, returning the document's new rev. If the document doesn't yet
+// exist, pass an empty rev to create it.
+func (db *Database) PutAttachment(docID, rev, name, contentType string, r io.Reader) (string, error) {
+	path := db.Server + "/" + db.Name + "/" + docID + "/" + name
+	if rev != "" {
+		path += "?rev=" + url.QueryEscape(rev)
+	}
+
+	req, err := http.NewRequest("PUT", path, r)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("content-type", contentType)
+	db.authenticate(req)
+
+	resp, err := db.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", newError(req, docID, resp)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var result docResponse
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return "", err
+	}
+
+	return result.Rev, nil
+}
+
+// GetAttachment returns the raw body and content type of a named
+// attachment on docID. The caller is responsible for closing the
+// returned io.ReadCloser.
+func (db *Database) GetAttachment(docID, name string) (io.ReadCloser, string, error) {
+	req, err := http.NewRequest("GET", db.Server + "/" + db.Name + "/" + docID + "/" + name, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	db.authenticate(req)
+
+	resp, err := db.do(req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, "", newError(req, docID, resp)
+	}
+
+	return resp.Body, resp.Header.Get("content-type"), nil
+}
+
+// DeleteAttachment removes a named attachment from docID, returning the
+// document's new rev.
+func (db *Database) DeleteAttachment(docID, rev, name string) (string, error) {
+	path := db.Server + "/" + db.Name + "/" + docID + "/" + name + "?rev=" + url.QueryEscape(rev)
+
+	req, err := http.NewRequest("DELETE", path, nil)
+	if err != nil {
+		return "", err
+	}
+	db.authenticate(req)
+
+	resp, err := db.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", newError(req, docID, resp)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
 	}
 
-	err = fmt.Errorf("unexpected status code %v from couchdb", resp.StatusCode)
-	if db.Panicky { panic(err) }
-	return "", err
+	var result docResponse
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return "", err
+	}
+
+	return result.Rev, nil
 }
 
 func (db *Database) UUID() (string, error) {
-	resp, err := http.Get(db.Server + "/_uuids")
+	req, err := db.newRequest("GET", db.Server + "/_uuids", nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := db.do(req)
 	if err != nil {
-		if db.Panicky { panic(err) }
 		return "", err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return "", newError(req, "", resp)
+	}
+
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		if db.Panicky { panic(err) }
 		return "", err
 	}
 
 	var result map[string]interface{}
 	err = json.Unmarshal(body, &result)
 	if err != nil {
-		if db.Panicky { panic(err) }
 		return "", err
 	}
 
 	return result["uuids"].([]interface{})[0].(string), nil
 }
 
-func (db *Database) Query(query *ViewQuery, destRows interface{}) (int, error) {
+func (db *Database) Query(query *ViewQuery, destRows interface{}) (*ViewResult, error) {
 	viewPath := db.Server + "/" + db.Name + "/_design/" + query.Design + "/_view/" + query.Name
-	
+
 	queryValues := url.Values{}
 
+	if query.Key != nil {
+		s, err := json.Marshal(query.Key)
+		if err != nil {
+			return nil, err
+		}
+		queryValues.Set("key", string(s))
+	}
+
 	if query.StartKey != nil {
 		s, err := json.Marshal(query.StartKey)
 		if err != nil {
-			if db.Panicky { panic(err) }
-			return 0, err
+			return nil, err
 		}
 		queryValues.Set("startkey", string(s))
 	}
@@ -159,100 +664,396 @@ func (db *Database) Query(query *ViewQuery, destRows interface{}) (int, error) {
 	if query.EndKey != nil {
 		s, err := json.Marshal(query.EndKey)
 		if err != nil {
-			if db.Panicky { panic(err) }
-			return 0, err
+			return nil, err
 		}
 		queryValues.Set("endkey", string(s))
 	}
 
-	resp, err := http.Get(viewPath + "?" + queryValues.Encode())
+	if query.StartKeyDocID != "" {
+		queryValues.Set("startkey_docid", query.StartKeyDocID)
+	}
+
+	if query.EndKeyDocID != "" {
+		queryValues.Set("endkey_docid", query.EndKeyDocID)
+	}
+
+	if query.Limit != 0 {
+		queryValues.Set("limit", strconv.Itoa(query.Limit))
+	}
+
+	if query.Skip != 0 {
+		queryValues.Set("skip", strconv.Itoa(query.Skip))
+	}
+
+	if query.Descending {
+		queryValues.Set("descending", "true")
+	}
+
+	if query.Group {
+		queryValues.Set("group", "true")
+	}
+
+	if query.GroupLevel != 0 {
+		queryValues.Set("group_level", strconv.Itoa(query.GroupLevel))
+	}
+
+	if query.Reduce != nil {
+		queryValues.Set("reduce", strconv.FormatBool(*query.Reduce))
+	}
+
+	if query.IncludeDocs {
+		queryValues.Set("include_docs", "true")
+	}
+
+	if query.InclusiveEnd != nil {
+		queryValues.Set("inclusive_end", strconv.FormatBool(*query.InclusiveEnd))
+	}
+
+	if query.Stale != "" {
+		queryValues.Set("stale", query.Stale)
+	}
+
+	buildRequest := func() (*http.Request, error) {
+		if len(query.Keys) > 0 {
+			return db.newRequest("POST", viewPath + "?" + queryValues.Encode(), map[string]interface{}{"keys": query.Keys})
+		}
+		return db.newRequest("GET", viewPath + "?" + queryValues.Encode(), nil)
+	}
+
+	req, err := buildRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := db.do(req)
 	if err != nil {
-		if db.Panicky { panic(err) }
-		return 0, err
+		return nil, err
 	}
 
 	if resp.StatusCode == http.StatusNotFound && query.MapDef != "" {
 		resp.Body.Close()
 
-		err = db.initView(query);
+		err = db.ensureView(query);
+		if err != nil {
+			return nil, err
+		}
+
+		req, err = buildRequest()
 		if err != nil {
-			if db.Panicky { panic(err) }
-			return 0, err
+			return nil, err
 		}
 
-		resp, err = http.Get(viewPath + "?" + queryValues.Encode())
+		resp, err = db.do(req)
 		if err != nil {
-			if db.Panicky { panic(err) }
-			return 0, err
+			return nil, err
 		}
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("unexpected status code %v from couchdb", resp.StatusCode)
-		if db.Panicky { panic(err) }
-		return 0, err
+		return nil, newError(req, "_design/"+query.Design, resp)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		if db.Panicky { panic(err) }
-		return 0, err
+		return nil, err
 	}
 
-	var result viewQueryResult
-	result.Rows = destRows
+	result := &ViewResult{Rows: destRows}
 
-	err = json.Unmarshal(body, &result)
+	err = json.Unmarshal(body, result)
 	if err != nil {
-		if db.Panicky { panic(err) }
-		return 0, err
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// DesignDocView is a single view definition within a DesignDoc.
+type DesignDocView struct {
+	Map    string `json:"map"`
+	Reduce string `json:"reduce,omitempty"`
+}
+
+// DesignDoc models a CouchDB design document: its views plus the other
+// function types (lists, shows, filters, validation) a design doc can
+// carry, so callers can register Erlang or Query Server views directly.
+type DesignDoc struct {
+	ID                string                   `json:"_id"`
+	Rev               string                   `json:"_rev,omitempty"`
+	Language          string                   `json:"language,omitempty"`
+	Views             map[string]DesignDocView `json:"views,omitempty"`
+	Lists             map[string]string        `json:"lists,omitempty"`
+	Shows             map[string]string        `json:"shows,omitempty"`
+	Filters           map[string]string        `json:"filters,omitempty"`
+	ValidateDocUpdate string                   `json:"validate_doc_update,omitempty"`
+}
+
+// GetDesignDoc fetches the named design document. The returned bool is
+// false, with a nil error, if the design document does not exist.
+func (db *Database) GetDesignDoc(name string) (*DesignDoc, bool, error) {
+	var doc DesignDoc
+	found, err := db.GetDoc("_design/"+name, &doc)
+	if err != nil || !found {
+		return nil, found, err
 	}
+	return &doc, true, nil
+}
 
-	return result.Offset, nil
+// PutDesignDoc creates or updates the named design document, returning
+// its new rev. doc.Rev must be set to the current rev when updating.
+func (db *Database) PutDesignDoc(name string, doc *DesignDoc) (string, error) {
+	doc.ID = "_design/" + name
+	return db.PutDoc(doc.ID, doc)
 }
 
-func (db *Database) initView(query *ViewQuery) (err error) {
-	view := make(map[string]interface{})
-	view["map"] = query.MapDef
-	if query.ReduceDef != "" {
-		view["reduce"] = query.ReduceDef
+// ensureView merges query's view (and any lists/shows/filters/language it
+// carries) into its design document, fetching the current document first
+// so unrelated views already registered there are preserved.
+func (db *Database) ensureView(query *ViewQuery) error {
+	doc, found, err := db.GetDesignDoc(query.Design)
+	if err != nil {
+		return err
+	}
+	if !found {
+		doc = &DesignDoc{}
 	}
 
-	views := map[string]interface{}{
-		query.Name : view,
+	if doc.Views == nil {
+		doc.Views = make(map[string]DesignDocView)
 	}
+	doc.Views[query.Name] = DesignDocView{Map: query.MapDef, Reduce: query.ReduceDef}
 
-	doc := map[string]interface{}{
-		"_id"   : "_design/" + query.Design,
-		"views" : views,
+	if query.Language != "" {
+		doc.Language = query.Language
+	}
+	if query.ValidateDocUpdate != "" {
+		doc.ValidateDocUpdate = query.ValidateDocUpdate
 	}
+	mergeStrings(&doc.Lists, query.Lists)
+	mergeStrings(&doc.Shows, query.Shows)
+	mergeStrings(&doc.Filters, query.Filters)
 
-	encoded, err := json.Marshal(doc)
-	if err != nil {
+	_, err = db.PutDesignDoc(query.Design, doc)
+	return err
+}
+
+// mergeStrings copies src into *dest, allocating *dest if it's nil and
+// src is non-empty.
+func mergeStrings(dest *map[string]string, src map[string]string) {
+	if len(src) == 0 {
 		return
 	}
-	
-	client := &http.Client{}
-	
-	req, err := http.NewRequest("PUT", db.Server + "/" + db.Name + "/_design/" + query.Design, bytes.NewReader(encoded))
+	if *dest == nil {
+		*dest = make(map[string]string)
+	}
+	for k, v := range src {
+		(*dest)[k] = v
+	}
+}
+
+// ChangesOptions configures a call to Database.Changes.
+type ChangesOptions struct {
+	Since       string
+	Filter      string
+	IncludeDocs bool
+	Heartbeat   int
+
+	// Feed selects "continuous" (the default) or "longpoll".
+	Feed string
+
+	// Context, if set, cancels the feed and closes ChangeStream.Changes
+	// when done. Defaults to context.Background().
+	Context context.Context
+}
+
+// ChangeRev is one entry of a Change's Changes slice, naming a leaf
+// revision touched by the update.
+type ChangeRev struct {
+	Rev string `json:"rev"`
+}
+
+// Change is a single entry from a database's _changes feed.
+type Change struct {
+	Seq     interface{} `json:"seq"`
+	ID      string      `json:"id"`
+	Changes []ChangeRev `json:"changes"`
+	Deleted bool        `json:"deleted"`
+	Doc     interface{} `json:"doc"`
+}
+
+// ChangeStream delivers Change values read from a database's _changes
+// feed. Changes is closed when the feed is stopped via Close, its Context
+// is done, or it hits a permanent failure (401, 403 or 404). Errors
+// receives the failures the feed hits, including that permanent one; an
+// error is dropped if the previous one has not been read yet. Errors is
+// never closed.
+type ChangeStream struct {
+	Changes chan Change
+	Errors  chan error
+
+	cancel context.CancelFunc
+}
+
+// Close stops the feed and closes the Changes channel.
+func (cs *ChangeStream) Close() {
+	cs.cancel()
+}
+
+// Changes opens db's _changes feed and streams updates on the returned
+// ChangeStream until it is closed or its Context is done. The connection
+// is automatically reestablished from the last seen sequence if it drops.
+func (db *Database) Changes(opts ChangesOptions) (*ChangeStream, error) {
+	parent := opts.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+
+	stream := &ChangeStream{
+		Changes: make(chan Change),
+		Errors:  make(chan error, 1),
+		cancel:  cancel,
+	}
+
+	go db.runChangesFeed(ctx, opts, stream)
+
+	return stream, nil
+}
+
+func (db *Database) runChangesFeed(ctx context.Context, opts ChangesOptions, stream *ChangeStream) {
+	defer close(stream.Changes)
+
+	since := opts.Since
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		err := db.readChanges(ctx, opts, &since, stream)
+		if err != nil {
+			select {
+			case stream.Errors <- err:
+			default:
+			}
+
+			if isTerminalChangesErr(err) {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// isTerminalChangesErr reports whether err is a permanent failure (bad
+// credentials, a deleted or not-yet-created database) rather than a
+// dropped connection. runChangesFeed stops retrying on these instead of
+// hot-looping against a misconfiguration that will never succeed.
+func isTerminalChangesErr(err error) bool {
+	var cerr *Error
+	if !errors.As(err, &cerr) {
+		return false
+	}
+	switch cerr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return true
+	default:
+		return false
+	}
+}
+
+// readChanges opens a single _changes request and delivers Change values
+// until the feed ends (longpoll) or the connection drops (continuous),
+// advancing *since as it goes so the caller can reconnect from there.
+func (db *Database) readChanges(ctx context.Context, opts ChangesOptions, since *string, stream *ChangeStream) error {
+	feed := opts.Feed
+	if feed == "" {
+		feed = "continuous"
+	}
+
+	queryValues := url.Values{}
+	queryValues.Set("feed", feed)
+	if *since != "" {
+		queryValues.Set("since", *since)
+	}
+	if opts.Filter != "" {
+		queryValues.Set("filter", opts.Filter)
+	}
+	if opts.IncludeDocs {
+		queryValues.Set("include_docs", "true")
+	}
+	if opts.Heartbeat != 0 {
+		queryValues.Set("heartbeat", strconv.Itoa(opts.Heartbeat))
+	}
+
+	req, err := db.newRequest("GET", db.Server + "/" + db.Name + "/_changes?" + queryValues.Encode(), nil)
 	if err != nil {
-		return
+		return err
 	}
-	
-	req.Header.Add("content-type", "application/json")
-	
-	resp, err := client.Do(req)
+	req = req.WithContext(ctx)
+
+	resp, err := db.do(req)
 	if err != nil {
-		return
+		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusConflict {
-		err = fmt.Errorf("unexpected status code %v from couchdb", resp.StatusCode)
-		return
+	if resp.StatusCode != http.StatusOK {
+		return newError(req, "", resp)
 	}
 
-	return
+	if feed == "longpoll" {
+		var result struct {
+			Results []Change    `json:"results"`
+			LastSeq interface{} `json:"last_seq"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return err
+		}
+		for _, change := range result.Results {
+			select {
+			case stream.Changes <- change:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		if result.LastSeq != nil {
+			*since = fmt.Sprintf("%v", result.LastSeq)
+		}
+		return nil
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var change Change
+		err := decoder.Decode(&change)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if change.ID == "" && change.Seq == nil {
+			continue
+		}
+
+		select {
+		case stream.Changes <- change:
+		case <-ctx.Done():
+			return nil
+		}
+
+		if change.Seq != nil {
+			*since = fmt.Sprintf("%v", change.Seq)
+		}
+	}
 }
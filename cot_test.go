@@ -0,0 +1,426 @@
+package cot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestEnsureViewMergesExistingDesignDoc checks that ensureView preserves a
+// design document's existing views (and rev, for the PUT to succeed)
+// instead of clobbering them when registering a new one.
+func TestEnsureViewMergesExistingDesignDoc(t *testing.T) {
+	existing := DesignDoc{
+		ID:  "_design/widgets",
+		Rev: "1-abc",
+		Views: map[string]DesignDocView{
+			"by_name": {Map: "function(doc) { emit(doc.name, null); }"},
+		},
+	}
+
+	var putBody DesignDoc
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/testdb/_design/widgets", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(existing)
+		case http.MethodPut:
+			if err := json.NewDecoder(r.Body).Decode(&putBody); err != nil {
+				t.Fatalf("decoding PUT body: %v", err)
+			}
+			if putBody.Rev != existing.Rev {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(docResponse{Error: "conflict"})
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(docResponse{OK: true, ID: putBody.ID, Rev: "2-def"})
+		default:
+			t.Fatalf("unexpected method %v", r.Method)
+		}
+	})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	db := &Database{Server: ts.URL, Name: "testdb"}
+
+	err := db.ensureView(&ViewQuery{
+		Design: "widgets",
+		Name:   "by_price",
+		MapDef: "function(doc) { emit(doc.price, null); }",
+	})
+	if err != nil {
+		t.Fatalf("ensureView: %v", err)
+	}
+
+	if putBody.Rev != existing.Rev {
+		t.Fatalf("expected PUT to carry the fetched rev %q, got %q", existing.Rev, putBody.Rev)
+	}
+	if _, ok := putBody.Views["by_name"]; !ok {
+		t.Fatalf("expected existing view %q to be preserved, views: %#v", "by_name", putBody.Views)
+	}
+	if _, ok := putBody.Views["by_price"]; !ok {
+		t.Fatalf("expected new view %q to be registered, views: %#v", "by_price", putBody.Views)
+	}
+}
+
+// TestErrorIsMatchesSentinels checks that errors.Is matches a *Error
+// returned by newError against the package's sentinel errors by
+// StatusCode alone, ignoring the request-specific fields that naturally
+// differ (DocID/Method/Path/Reason).
+func TestErrorIsMatchesSentinels(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPut, "/testdb/widget1", nil)
+
+	rec := httptest.NewRecorder()
+	rec.Header().Set("content-type", "application/json")
+	rec.WriteHeader(http.StatusConflict)
+	rec.WriteString(`{"error":"conflict","reason":"Document update conflict."}`)
+
+	err := newError(req, "widget1", rec.Result())
+
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected errors.Is(err, ErrConflict) to match 409 response, got %v", err)
+	}
+	if errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected errors.Is(err, ErrNotFound) not to match a 409 response")
+	}
+	if err.DocID != "widget1" || err.Err != "conflict" {
+		t.Fatalf("expected newError to carry DocID/Err from the request and body, got %+v", err)
+	}
+}
+
+// TestDoReauthenticatesAndRetriesOn401 checks the happy path of do's 401
+// handling: a stale session cookie draws a 401, do re-authenticates via
+// startSession, and the original request is retried with the fresh
+// cookie and succeeds.
+func TestDoReauthenticatesAndRetriesOn401(t *testing.T) {
+	var sessionCalls, docCalls int32
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_session", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&sessionCalls, 1)
+		http.SetCookie(w, &http.Cookie{Name: "AuthSession", Value: "fresh-session"})
+		json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+	})
+	mux.HandleFunc("/testdb/doc1", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&docCalls, 1)
+		cookie, err := r.Cookie("AuthSession")
+		if err != nil || cookie.Value != "fresh-session" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"_id": "doc1"})
+	})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	db := &Database{Server: ts.URL, Name: "testdb", Username: "alice", Password: "secret"}
+	db.setSession(&http.Cookie{Name: "AuthSession", Value: "stale-session"})
+
+	req, err := db.newRequest("GET", ts.URL+"/testdb/doc1", nil)
+	if err != nil {
+		t.Fatalf("newRequest: %v", err)
+	}
+
+	resp, err := db.do(req)
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the retried request to succeed, got status %v", resp.StatusCode)
+	}
+	if atomic.LoadInt32(&sessionCalls) != 1 {
+		t.Fatalf("expected exactly one re-authentication, got %v", sessionCalls)
+	}
+	if atomic.LoadInt32(&docCalls) != 2 {
+		t.Fatalf("expected the doc request to be tried twice (401 then retry), got %v", docCalls)
+	}
+	if db.session().Value != "fresh-session" {
+		t.Fatalf("expected the refreshed cookie to be cached, got %+v", db.session())
+	}
+}
+
+// unbufferedReader wraps an io.Reader so http.NewRequest can't recognize
+// it as one of the rewindable body types (*bytes.Reader, *bytes.Buffer,
+// *strings.Reader) and populate req.GetBody automatically, mirroring a
+// streaming PutAttachment upload.
+type unbufferedReader struct {
+	io.Reader
+}
+
+// TestDoSkipsRetryWhenBodyCannotBeReread checks that a 401 on a request
+// whose body can't be safely re-sent (no GetBody, same failure class as
+// the streamed PutAttachment bug fixed alongside this test) is returned
+// to the caller as-is, without do attempting a re-authenticated retry.
+func TestDoSkipsRetryWhenBodyCannotBeReread(t *testing.T) {
+	var sessionCalls, attachCalls int32
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_session", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&sessionCalls, 1)
+		http.SetCookie(w, &http.Cookie{Name: "AuthSession", Value: "fresh-session"})
+		json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+	})
+	mux.HandleFunc("/testdb/doc1/blob", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attachCalls, 1)
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	db := &Database{Server: ts.URL, Name: "testdb", Username: "alice", Password: "secret"}
+
+	req, err := http.NewRequest("PUT", ts.URL+"/testdb/doc1/blob", unbufferedReader{strings.NewReader("data")})
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	if req.GetBody != nil {
+		t.Fatalf("expected req.GetBody to be nil for an unbufferedReader body")
+	}
+	db.authenticate(req)
+
+	resp, err := db.do(req)
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the original 401 to be returned, got status %v", resp.StatusCode)
+	}
+	if atomic.LoadInt32(&sessionCalls) != 0 {
+		t.Fatalf("expected no re-authentication attempt, got %v", sessionCalls)
+	}
+	if atomic.LoadInt32(&attachCalls) != 1 {
+		t.Fatalf("expected the attachment request to be tried exactly once, got %v", attachCalls)
+	}
+}
+
+// TestSessionConcurrentAccess drives session() and setSession() from many
+// goroutines at once, the shape of a Changes feed goroutine racing other
+// callers on the same Database. Run with -race to catch the data race
+// that shipped before 7de2901.
+func TestSessionConcurrentAccess(t *testing.T) {
+	db := &Database{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			db.setSession(&http.Cookie{Name: "AuthSession", Value: "session"})
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			_ = db.session()
+		}(i)
+	}
+	wg.Wait()
+}
+
+// TestReadChangesContinuousFeedAdvancesSince checks that readChanges
+// decodes a line-delimited continuous feed into individual Change values
+// and advances *since to the last sequence seen.
+func TestReadChangesContinuousFeedAdvancesSince(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/testdb/_changes", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("feed") != "continuous" {
+			t.Fatalf("expected feed=continuous, got %q", r.URL.Query().Get("feed"))
+		}
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, `{"seq":1,"id":"doc1","changes":[{"rev":"1-a"}]}`)
+		fmt.Fprintln(w, `{"seq":2,"id":"doc2","changes":[{"rev":"1-b"}]}`)
+	})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	db := &Database{Server: ts.URL, Name: "testdb"}
+	stream := &ChangeStream{Changes: make(chan Change), Errors: make(chan error, 1)}
+	since := ""
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- db.readChanges(context.Background(), ChangesOptions{}, &since, stream) }()
+
+	var got []Change
+	for i := 0; i < 2; i++ {
+		select {
+		case c := <-stream.Changes:
+			got = append(got, c)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for change %d", i+1)
+		}
+	}
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("readChanges: %v", err)
+	}
+	if len(got) != 2 || got[0].ID != "doc1" || got[1].ID != "doc2" {
+		t.Fatalf("unexpected changes: %+v", got)
+	}
+	if since != "2" {
+		t.Fatalf("expected since to advance to %q, got %q", "2", since)
+	}
+}
+
+// TestReadChangesLongpollDecodesResults checks that readChanges decodes a
+// longpoll response's {results,last_seq} envelope into Change values and
+// advances *since to last_seq.
+func TestReadChangesLongpollDecodesResults(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/testdb/_changes", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("feed") != "longpoll" {
+			t.Fatalf("expected feed=longpoll, got %q", r.URL.Query().Get("feed"))
+		}
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"results": []Change{
+				{Seq: float64(1), ID: "doc1", Changes: []ChangeRev{{Rev: "1-a"}}},
+				{Seq: float64(2), ID: "doc2", Changes: []ChangeRev{{Rev: "1-b"}}},
+			},
+			"last_seq": 2,
+		})
+	})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	db := &Database{Server: ts.URL, Name: "testdb"}
+	stream := &ChangeStream{Changes: make(chan Change), Errors: make(chan error, 1)}
+	since := ""
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- db.readChanges(context.Background(), ChangesOptions{Feed: "longpoll"}, &since, stream) }()
+
+	var got []Change
+	for i := 0; i < 2; i++ {
+		select {
+		case c := <-stream.Changes:
+			got = append(got, c)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for change %d", i+1)
+		}
+	}
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("readChanges: %v", err)
+	}
+	if len(got) != 2 || got[0].ID != "doc1" || got[1].ID != "doc2" {
+		t.Fatalf("unexpected changes: %+v", got)
+	}
+	if since != "2" {
+		t.Fatalf("expected since to advance to %q, got %q", "2", since)
+	}
+}
+
+// TestRunChangesFeedStopsOnTerminalError checks that a 404 (e.g. the
+// database doesn't exist) makes runChangesFeed stop after a single
+// attempt instead of hot-looping, while still surfacing the error.
+func TestRunChangesFeedStopsOnTerminalError(t *testing.T) {
+	var calls int32
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/testdb/_changes", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	db := &Database{Server: ts.URL, Name: "testdb"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream := &ChangeStream{Changes: make(chan Change), Errors: make(chan error, 1)}
+
+	done := make(chan struct{})
+	go func() {
+		db.runChangesFeed(ctx, ChangesOptions{}, stream)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("runChangesFeed did not stop on a terminal 404")
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("expected exactly one request before stopping, got %v", n)
+	}
+
+	select {
+	case err := <-stream.Errors:
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected the surfaced error to match ErrNotFound, got %v", err)
+		}
+	default:
+		t.Fatalf("expected a terminal error on stream.Errors")
+	}
+
+	if _, open := <-stream.Changes; open {
+		t.Fatalf("expected stream.Changes to be closed")
+	}
+}
+
+// TestRunChangesFeedRetriesOnTransientError checks that a transient
+// failure (e.g. a dropped connection, modeled here as a 500) is retried
+// rather than treated as terminal, until the caller cancels the feed.
+func TestRunChangesFeedRetriesOnTransientError(t *testing.T) {
+	var calls int32
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/testdb/_changes", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	db := &Database{Server: ts.URL, Name: "testdb"}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stream := &ChangeStream{Changes: make(chan Change), Errors: make(chan error, 1)}
+
+	done := make(chan struct{})
+	go func() {
+		db.runChangesFeed(ctx, ChangesOptions{}, stream)
+		close(done)
+	}()
+
+	// Let the retry loop fire at least twice (it backs off one second
+	// between attempts) before cancelling, to prove it didn't stop on
+	// the first 500 the way it does on a 404/401.
+	time.Sleep(1500 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("runChangesFeed did not stop after its context was cancelled")
+	}
+
+	if n := atomic.LoadInt32(&calls); n < 2 {
+		t.Fatalf("expected runChangesFeed to retry a transient error, got %v call(s)", n)
+	}
+}